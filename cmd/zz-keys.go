@@ -21,6 +21,7 @@ import (
 	"crypto/subtle"
 	"errors"
 	"strings"
+	"time"
 
 	"github.com/ItalyPaleAle/prvt/crypto"
 	"github.com/ItalyPaleAle/prvt/infofile"
@@ -29,6 +30,9 @@ import (
 	"github.com/manifoldco/promptui"
 )
 
+// kdfBenchmarkTarget is the duration `repo init` and `repo key rekdf` try to hit when auto-tuning Argon2id parameters
+const kdfBenchmarkTarget = 500 * time.Millisecond
+
 // PromptPassphrase prompts the user for a passphrase
 func PromptPassphrase() (string, error) {
 	prompt := promptui.Prompt{
@@ -50,8 +54,9 @@ func PromptPassphrase() (string, error) {
 	return key, err
 }
 
-// NewInfoFile generates a new info file with a brand-new master key, wrapped either with a passphrase-derived key, or with GPG
-func NewInfoFile(gpgKey string) (info *infofile.InfoFile, errMessage string, err error) {
+// NewInfoFile generates a new info file with a brand-new master key, wrapped either with a passphrase-derived key,
+// with GPG, with a KMS, with a PKCS#11 module, with an ssh-agent key, or with a FIDO2 security key
+func NewInfoFile(gpgKey string, kmsKey string, pkcs11Key string, sshKey string, fido2Device string) (info *infofile.InfoFile, errMessage string, err error) {
 	// First, create the info file
 	info, err = infofile.New()
 	if err != nil {
@@ -65,7 +70,7 @@ func NewInfoFile(gpgKey string) (info *infofile.InfoFile, errMessage string, err
 	}
 
 	// Add the key
-	errMessage, err = AddKey(info, masterKey, gpgKey)
+	errMessage, err = AddKey(info, masterKey, gpgKey, kmsKey, pkcs11Key, sshKey, fido2Device)
 	if err != nil {
 		info = nil
 	}
@@ -75,8 +80,8 @@ func NewInfoFile(gpgKey string) (info *infofile.InfoFile, errMessage string, err
 
 // UpgradeInfoFile upgrades an info file to the latest version
 func UpgradeInfoFile(info *infofile.InfoFile) (errMessage string, err error) {
-	// Can only upgrade info files version 1 and 2
-	if info.Version != 1 && info.Version != 2 {
+	// Can only upgrade info files version 1, 2, and 3
+	if info.Version != 1 && info.Version != 2 && info.Version != 3 {
 		return "Unsupported repository version", errors.New("This repository has already been upgraded or is using an unsupported version")
 	}
 
@@ -94,8 +99,16 @@ func UpgradeInfoFile(info *infofile.InfoFile) (errMessage string, err error) {
 	/*if info.Version < 3 {
 	}*/
 
+	// Upgrade 3 -> 4
+	if info.Version < 4 {
+		errMessage, err = upgradeInfoFileV3(info)
+		if err != nil {
+			return errMessage, err
+		}
+	}
+
 	// Update the version
-	info.Version = 3
+	info.Version = 4
 
 	return "", nil
 }
@@ -135,8 +148,8 @@ func upgradeInfoFileV1(info *infofile.InfoFile) (errMessage string, err error) {
 			return "Error wrapping the master key", err
 		}
 
-		// Add the key
-		err = info.AddPassphrase(newSalt, newConfirmationHash, wrappedKey)
+		// Add the key, keeping the legacy KDF since we haven't re-prompted for the passphrase here
+		err = info.AddPassphrase(newSalt, newConfirmationHash, wrappedKey, crypto.KdfLegacy, crypto.KdfOpts{})
 		if err != nil {
 			return "Error adding the key", err
 		}
@@ -149,13 +162,42 @@ func upgradeInfoFileV1(info *infofile.InfoFile) (errMessage string, err error) {
 	return "", nil
 }
 
+// Upgrade an info file from version 3 to 4
+// This offers to re-wrap existing legacy passphrase keys with Argon2id; GPG, KMS, and PKCS#11 keys are untouched
+func upgradeInfoFileV3(info *infofile.InfoFile) (errMessage string, err error) {
+	for i, k := range info.Keys {
+		if len(k.Salt) == 0 || len(k.ConfirmationHash) == 0 {
+			continue
+		}
+		if k.Kdf != "" && k.Kdf != crypto.KdfLegacy {
+			continue
+		}
+
+		// Prompt for the passphrase to get the current master key
+		passphrase, err := PromptPassphrase()
+		if err != nil {
+			return "Error getting passphrase", err
+		}
+
+		masterKey, _, _, err := keys.GetMasterKeyWithPassphrase(info, passphrase)
+		if err != nil {
+			return "Cannot unlock the repository", errors.New("Invalid passphrase")
+		}
+
+		errMessage, err = rewrapPassphraseWithArgon2id(info, i, passphrase, masterKey, BenchmarkKdfOpts())
+		if err != nil {
+			return errMessage, err
+		}
+	}
+
+	return "", nil
+}
+
 // AddKey adds a key to an info file
-// If the GPG Key is empty, will prompt for a passphrase
-func AddKey(info *infofile.InfoFile, masterKey []byte, gpgKey string) (errMessage string, err error) {
-	if gpgKey == "" {
-		// Add the passphrase
-		return addKeyPassphrase(info, masterKey)
-	} else {
+// If the GPG key, the KMS key, the PKCS#11 key, the ssh-agent key, and the FIDO2 device are all empty, will prompt for a passphrase
+func AddKey(info *infofile.InfoFile, masterKey []byte, gpgKey string, kmsKey string, pkcs11Key string, sshKey string, fido2Device string) (errMessage string, err error) {
+	switch {
+	case gpgKey != "":
 		// Before adding the key, check if it's already there
 		// Lowercase the key ID for normalization
 		keyId := strings.ToLower(gpgKey)
@@ -167,10 +209,44 @@ func AddKey(info *infofile.InfoFile, masterKey []byte, gpgKey string) (errMessag
 
 		// Add the GPG key
 		return addKeyGPG(info, masterKey, gpgKey)
+	case kmsKey != "":
+		// Before adding the key, check if it's already there
+		for _, k := range info.Keys {
+			if k.KMSKeyURI == kmsKey {
+				return "Key already added", errors.New("This KMS key has already been added to the repository")
+			}
+		}
+
+		// Add the KMS key
+		return addKeyKMS(info, masterKey, kmsKey)
+	case pkcs11Key != "":
+		// Before adding the key, check if it's already there
+		for _, k := range info.Keys {
+			if k.PKCS11URI == pkcs11Key {
+				return "Key already added", errors.New("This PKCS#11 key has already been added to the repository")
+			}
+		}
+
+		// Add the PKCS#11 key
+		return addKeyPKCS11(info, masterKey, pkcs11Key)
+	case sshKey != "":
+		// Add the ssh-agent key; duplicate detection happens after wrapping, once we know the identity's fingerprint
+		return addKeySSHAgent(info, masterKey, sshKey)
+	case fido2Device != "":
+		// Add the FIDO2 security key; this enrolls a brand-new credential, so it can never already be in the repository
+		return addKeyWebAuthn(info, masterKey, fido2Device)
+	default:
+		// Add the passphrase
+		return addKeyPassphrase(info, masterKey)
 	}
 }
 
-// Used by AddKey to add a new passphrase
+// BenchmarkKdfOpts benchmarks the current host and returns Argon2id parameters targeting kdfBenchmarkTarget
+func BenchmarkKdfOpts() crypto.KdfOpts {
+	return crypto.BenchmarkKdfOpts(kdfBenchmarkTarget)
+}
+
+// Used by AddKey to add a new passphrase, protected with Argon2id
 func addKeyPassphrase(info *infofile.InfoFile, masterKey []byte) (errMessage string, err error) {
 	var salt, confirmationHash, wrappedKey []byte
 
@@ -186,13 +262,14 @@ func addKeyPassphrase(info *infofile.InfoFile, masterKey []byte) (errMessage str
 		return "Key already added", errors.New("This passphrase has already been added to the repository")
 	}
 
-	// Derive the wrapping key, after generating a new salt
+	// Derive the wrapping key with Argon2id, after generating a new salt and benchmarking the KDF parameters
 	salt, err = crypto.NewSalt()
 	if err != nil {
 		return "Error generating a new salt", err
 	}
+	kdfOpts := BenchmarkKdfOpts()
 	var wrappingKey []byte
-	wrappingKey, confirmationHash, err = crypto.KeyFromPassphrase(passphrase, salt)
+	wrappingKey, confirmationHash, err = crypto.KeyFromPassphraseArgon2id(passphrase, salt, kdfOpts)
 	if err != nil {
 		return "Error deriving the wrapping key", err
 	}
@@ -204,7 +281,7 @@ func addKeyPassphrase(info *infofile.InfoFile, masterKey []byte) (errMessage str
 	}
 
 	// Add the key
-	err = info.AddPassphrase(salt, confirmationHash, wrappedKey)
+	err = info.AddPassphrase(salt, confirmationHash, wrappedKey, crypto.KdfArgon2id, kdfOpts)
 	if err != nil {
 		return "Error adding the key", err
 	}
@@ -212,6 +289,76 @@ func addKeyPassphrase(info *infofile.InfoFile, masterKey []byte) (errMessage str
 	return "", nil
 }
 
+// rewrapPassphraseWithArgon2id re-derives the wrapping key for the passphrase entry at index i using Argon2id and the
+// given parameters, then replaces the entry in place. Used by both the v3 -> v4 upgrade and RekdfPassphrase
+func rewrapPassphraseWithArgon2id(info *infofile.InfoFile, i int, passphrase string, masterKey []byte, kdfOpts crypto.KdfOpts) (errMessage string, err error) {
+	newSalt, err := crypto.NewSalt()
+	if err != nil {
+		return "Error generating a new salt", err
+	}
+
+	wrappingKey, confirmationHash, err := crypto.KeyFromPassphraseArgon2id(passphrase, newSalt, kdfOpts)
+	if err != nil {
+		return "Error deriving the wrapping key", err
+	}
+
+	wrappedKey, err := crypto.WrapKey(wrappingKey, masterKey)
+	if err != nil {
+		return "Error wrapping the master key", err
+	}
+
+	err = info.UpdatePassphrase(i, newSalt, confirmationHash, wrappedKey, crypto.KdfArgon2id, kdfOpts)
+	if err != nil {
+		return "Error updating the key", err
+	}
+
+	return "", nil
+}
+
+// deriveWrappingKey derives a wrapping key and confirmation hash for a passphrase entry, dispatching on its KDF
+func deriveWrappingKey(passphrase string, salt []byte, kdf crypto.KdfAlgorithm, kdfOpts crypto.KdfOpts) (wrappingKey []byte, confirmationHash []byte, err error) {
+	if kdf == crypto.KdfArgon2id {
+		return crypto.KeyFromPassphraseArgon2id(passphrase, salt, kdfOpts)
+	}
+	// Missing or "legacy" KDF: fall back to the original KDF for backward compatibility
+	return crypto.KeyFromPassphrase(passphrase, salt)
+}
+
+// RekdfPassphrase re-tunes the Argon2id parameters for an existing passphrase-wrapped key, without changing the passphrase
+// This is used by the `prvt repo key rekdf` command
+func RekdfPassphrase(info *infofile.InfoFile) (errMessage string, err error) {
+	passphrase, err := PromptPassphrase()
+	if err != nil {
+		return "Error getting passphrase", err
+	}
+
+	for i, k := range info.Keys {
+		if len(k.Salt) == 0 || len(k.ConfirmationHash) == 0 {
+			continue
+		}
+
+		_, confirmationHash, deriveErr := deriveWrappingKey(passphrase, k.Salt, k.Kdf, k.KdfOpts)
+		if deriveErr != nil || subtle.ConstantTimeCompare(k.ConfirmationHash, confirmationHash) == 0 {
+			continue
+		}
+
+		masterKey, _, errMessage, err := keys.GetMasterKeyWithPassphrase(info, passphrase)
+		if err != nil {
+			return errMessage, err
+		}
+
+		return rewrapPassphraseWithArgon2id(info, i, passphrase, masterKey, BenchmarkKdfOpts())
+	}
+
+	return "Cannot unlock the repository", errors.New("Invalid passphrase")
+}
+
+// UnlockWithFIDO2 gets the master key by unwrapping it with a FIDO2 security key over CTAP2
+// Unlike GetMasterKey's other backends, this requires an explicit device path, so it isn't tried automatically
+func UnlockWithFIDO2(info *infofile.InfoFile, devicePath string) (masterKey []byte, keyId string, errMessage string, err error) {
+	return keys.GetMasterKeyWithWebAuthn(info, devicePath)
+}
+
 // Used by AddKey to add a new GPG key
 func addKeyGPG(info *infofile.InfoFile, masterKey []byte, gpgKey string) (errMessage string, err error) {
 	var wrappedKey []byte
@@ -231,7 +378,79 @@ func addKeyGPG(info *infofile.InfoFile, masterKey []byte, gpgKey string) (errMes
 	return "", nil
 }
 
-// GetMasterKey gets the master key, either unwrapping it with a passphrase or with GPG
+// Used by AddKey to add a new KMS-wrapped key
+// kmsKey is a URI identifying the remote key, currently only awskms://alias/prvt-master (or an AWS KMS key ARN);
+// gcpkms://, azurekeyvault://, and vault:// are recognized schemes reserved for backends that aren't implemented yet
+func addKeyKMS(info *infofile.InfoFile, masterKey []byte, kmsKey string) (errMessage string, err error) {
+	var wrappedKey []byte
+
+	// Use the KMS to wrap the master key
+	wrappedKey, err = keys.KMSWrap(masterKey, kmsKey)
+	if err != nil {
+		return "Error wrapping the master key with the KMS", err
+	}
+
+	// Add the key
+	err = info.AddKMSWrappedKey(kmsKey, wrappedKey)
+	if err != nil {
+		return "Error adding the key", err
+	}
+
+	return "", nil
+}
+
+// Used by AddKey to add a new PKCS#11-wrapped key
+// pkcs11Key is a "pkcs11:token=...;object=..." URI identifying the token and key object to use
+func addKeyPKCS11(info *infofile.InfoFile, masterKey []byte, pkcs11Key string) (errMessage string, err error) {
+	var wrappedKey []byte
+
+	// Use the PKCS#11 module to wrap the master key
+	wrappedKey, err = keys.PKCS11Wrap(masterKey, pkcs11Key)
+	if err != nil {
+		return "Error wrapping the master key with the PKCS#11 module", err
+	}
+
+	// Add the key
+	err = info.AddPKCS11WrappedKey(pkcs11Key, wrappedKey)
+	if err != nil {
+		return "Error adding the key", err
+	}
+
+	return "", nil
+}
+
+// Used by AddKey to add a new ssh-agent-wrapped key
+// sshKey identifies which identity in the agent to use, either its SHA256 fingerprint or an empty string for the first one
+func addKeySSHAgent(info *infofile.InfoFile, masterKey []byte, sshKey string) (errMessage string, err error) {
+	// Use ssh-agent to wrap the master key
+	fingerprint, pubkey, salt, wrappedKey, err := keys.SSHAgentWrap(masterKey, sshKey)
+	if err != nil {
+		return "Error wrapping the master key with ssh-agent", err
+	}
+
+	// Before adding the key, check if it's already there
+	for _, k := range info.Keys {
+		if k.SSHFingerprint == fingerprint {
+			return "Key already added", errors.New("This ssh-agent key has already been added to the repository")
+		}
+	}
+
+	// Add the key
+	err = info.AddSSHWrappedKey(fingerprint, pubkey, salt, wrappedKey)
+	if err != nil {
+		return "Error adding the key", err
+	}
+
+	return "", nil
+}
+
+// Used by AddKey to enroll a new FIDO2 security key
+// fido2Device is the device path (e.g. /dev/hidraw0 on Linux) as returned by libfido2's device enumeration
+func addKeyWebAuthn(info *infofile.InfoFile, masterKey []byte, fido2Device string) (errMessage string, err error) {
+	return keys.EnrollWebAuthn(info, masterKey, fido2Device)
+}
+
+// GetMasterKey gets the master key, either unwrapping it with a passphrase, with GPG, with a KMS, with a PKCS#11 module, or with ssh-agent
 func GetMasterKey(info *infofile.InfoFile) (masterKey []byte, keyId string, errMessage string, err error) {
 	// First, try unwrapping the key using GPG
 	masterKey, keyId, errMessage, err = keys.GetMasterKeyWithGPG(info)
@@ -239,7 +458,25 @@ func GetMasterKey(info *infofile.InfoFile) (masterKey []byte, keyId string, errM
 		return
 	}
 
-	// No GPG key specified or unlocking with a GPG key was not successful
+	// Then, try unwrapping the key using a KMS
+	masterKey, keyId, errMessage, err = keys.GetMasterKeyWithKMS(info)
+	if err == nil {
+		return
+	}
+
+	// Then, try unwrapping the key using a PKCS#11 module
+	masterKey, keyId, errMessage, err = keys.GetMasterKeyWithPKCS11(info)
+	if err == nil {
+		return
+	}
+
+	// Then, try unwrapping the key using ssh-agent, before falling back to a passphrase prompt
+	masterKey, keyId, errMessage, err = keys.GetMasterKeyWithSSHAgent(info)
+	if err == nil {
+		return
+	}
+
+	// No GPG, KMS, PKCS#11, or ssh-agent key could unlock the repository
 	// We'll try with passphrases; first, prompt for it
 	passphrase, err := PromptPassphrase()
 	if err != nil {
@@ -0,0 +1,115 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"errors"
+	"strings"
+
+	"github.com/ItalyPaleAle/prvt/crypto"
+	"github.com/ItalyPaleAle/prvt/infofile"
+)
+
+// sharePrefix is prepended to every encoded share, so a share string can be recognized and versioned at a glance
+const sharePrefix = "prvt-share-v1-"
+
+// ShareMasterKey splits masterKey into n Shamir shares, threshold of which are needed to reconstruct it
+// It returns the shares already encoded as "prvt-share-v1-..." strings, ready to be printed or written out
+// If info is not nil, a commitment to the master key is stored so UnlockWithShares can validate a reconstruction
+// before returning it; this doesn't let an individual share be validated on its own, only the fully combined result
+func ShareMasterKey(info *infofile.InfoFile, masterKey []byte, threshold int, n int) (encodedShares []string, errMessage string, err error) {
+	shares, err := crypto.ShamirSplit(masterKey, threshold, n)
+	if err != nil {
+		return nil, "Error splitting the master key", err
+	}
+
+	encodedShares = make([]string, len(shares))
+	for i, s := range shares {
+		encodedShares[i] = encodeShare(s)
+	}
+
+	if info != nil {
+		commitment := sha256.Sum256(masterKey)
+		if err := info.AddShareCommitment(threshold, n, commitment[:]); err != nil {
+			return nil, "Error storing the share commitment", err
+		}
+	}
+
+	return encodedShares, "", nil
+}
+
+// UnlockWithShares reconstructs the master key from a set of encoded shares produced by ShareMasterKey
+// This does not modify the info file. If info has a share commitment set, the reconstructed key is validated against it
+func UnlockWithShares(info *infofile.InfoFile, encodedShares []string) (masterKey []byte, errMessage string, err error) {
+	shares := make([][]byte, len(encodedShares))
+	for i, s := range encodedShares {
+		decoded, err := decodeShare(s)
+		if err != nil {
+			return nil, "Invalid share", err
+		}
+		shares[i] = decoded
+	}
+
+	masterKey, err = crypto.ShamirCombine(shares)
+	if err != nil {
+		return nil, "Error combining the shares", err
+	}
+
+	if info != nil && len(info.ShareCommitment) > 0 {
+		commitment := sha256.Sum256(masterKey)
+		if subtle.ConstantTimeCompare(info.ShareCommitment, commitment[:]) == 0 {
+			return nil, "Cannot unlock the repository", errors.New("the reconstructed key does not match the expected commitment; check that enough correct shares were provided")
+		}
+	}
+
+	return masterKey, "", nil
+}
+
+// encodeShare encodes a raw Shamir share as "prvt-share-v1-<base32>", appending a one-byte checksum so
+// a mistyped share is rejected immediately rather than silently producing a wrong reconstruction
+func encodeShare(share []byte) string {
+	checksum := sha256.Sum256(share)
+	payload := append(append([]byte{}, share...), checksum[0])
+	return sharePrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(payload)
+}
+
+// decodeShare reverses encodeShare, verifying the checksum
+func decodeShare(encoded string) ([]byte, error) {
+	if !strings.HasPrefix(encoded, sharePrefix) {
+		return nil, errors.New("share is missing the " + sharePrefix + " prefix")
+	}
+
+	payload, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimPrefix(encoded, sharePrefix))
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < 2 {
+		return nil, errors.New("share is too short")
+	}
+
+	share, checksum := payload[:len(payload)-1], payload[len(payload)-1]
+	want := sha256.Sum256(share)
+	if checksum != want[0] {
+		return nil, errors.New("share checksum does not match; it may have been mistyped")
+	}
+
+	return share, nil
+}
@@ -0,0 +1,63 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package cmd
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestEncodeDecodeShareRoundTrip(t *testing.T) {
+	share := []byte{0x01, 0xde, 0xad, 0xbe, 0xef}
+
+	encoded := encodeShare(share)
+	if !strings.HasPrefix(encoded, sharePrefix) {
+		t.Fatalf("encoded share is missing the %q prefix: %s", sharePrefix, encoded)
+	}
+
+	decoded, err := decodeShare(encoded)
+	if err != nil {
+		t.Fatalf("decodeShare failed: %v", err)
+	}
+	if !bytes.Equal(decoded, share) {
+		t.Fatalf("decoded share does not match: got %x, want %x", decoded, share)
+	}
+}
+
+func TestDecodeShareRejectsMissingPrefix(t *testing.T) {
+	if _, err := decodeShare("not-a-share"); err == nil {
+		t.Fatal("expected an error for a share missing the prefix, got none")
+	}
+}
+
+func TestDecodeShareRejectsCorruptedChecksum(t *testing.T) {
+	encoded := encodeShare([]byte{0x01, 0xde, 0xad, 0xbe, 0xef})
+
+	// Flip the last character of the encoded payload to corrupt its checksum byte
+	mangled := []byte(encoded)
+	if mangled[len(mangled)-1] == 'A' {
+		mangled[len(mangled)-1] = 'B'
+	} else {
+		mangled[len(mangled)-1] = 'A'
+	}
+
+	if _, err := decodeShare(string(mangled)); err == nil {
+		t.Fatal("expected an error for a share with a corrupted checksum, got none")
+	}
+}
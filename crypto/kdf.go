@@ -0,0 +1,85 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KdfAlgorithm identifies the key-derivation function used to protect a passphrase-wrapped key
+type KdfAlgorithm string
+
+const (
+	// KdfLegacy is the original scrypt-based KDF used by prvt before Argon2id support was added
+	KdfLegacy KdfAlgorithm = "legacy"
+	// KdfArgon2id is the memory-hard KDF used by default for new passphrase-wrapped keys
+	KdfArgon2id KdfAlgorithm = "argon2id"
+)
+
+// KdfOpts contains the tunable parameters for the Argon2id KDF
+// Memory is expressed in KiB, Time is the number of iterations, and Threads is the degree of parallelism
+type KdfOpts struct {
+	Memory  uint32
+	Time    uint32
+	Threads uint8
+}
+
+// DefaultKdfOpts returns a conservative set of Argon2id parameters, used when a benchmark isn't available
+func DefaultKdfOpts() KdfOpts {
+	return KdfOpts{
+		Memory:  64 * 1024, // 64 MiB
+		Time:    3,
+		Threads: 4,
+	}
+}
+
+// BenchmarkKdfOpts measures the current host's performance and returns Argon2id parameters
+// tuned to take approximately target to derive a key, starting from a fixed memory size and scaling the time parameter
+func BenchmarkKdfOpts(target time.Duration) KdfOpts {
+	opts := DefaultKdfOpts()
+	salt := make([]byte, SaltLength)
+
+	// Measure a single iteration, then scale the time parameter to approximate the target duration
+	start := time.Now()
+	argon2.IDKey([]byte("benchmark"), salt, 1, opts.Memory, opts.Threads, KeyLength)
+	elapsed := time.Since(start)
+	if elapsed <= 0 {
+		return opts
+	}
+
+	scaled := uint32(target / elapsed)
+	if scaled < 1 {
+		scaled = 1
+	}
+	opts.Time = scaled
+
+	return opts
+}
+
+// KeyFromPassphraseArgon2id derives a wrapping key and a confirmation hash from a passphrase and salt using Argon2id
+// The confirmation hash is a second, cheaper Argon2id derivation over the wrapping key and salt, so the wrapping key itself is never stored
+func KeyFromPassphraseArgon2id(passphrase string, salt []byte, opts KdfOpts) (key []byte, confirmationHash []byte, err error) {
+	key = argon2.IDKey([]byte(passphrase), salt, opts.Time, opts.Memory, opts.Threads, KeyLength)
+
+	// Derive the confirmation hash from the wrapping key and salt, mirroring the legacy KDF's approach
+	confirmationHash = argon2.IDKey(key, salt, 1, 8*1024, 1, KeyLength)
+
+	return key, confirmationHash, nil
+}
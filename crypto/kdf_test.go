@@ -0,0 +1,65 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestKeyFromPassphraseArgon2idIsDeterministic(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x42}, SaltLength)
+	opts := DefaultKdfOpts()
+
+	key1, hash1, err := KeyFromPassphraseArgon2id("correct horse battery staple", salt, opts)
+	if err != nil {
+		t.Fatalf("KeyFromPassphraseArgon2id failed: %v", err)
+	}
+	key2, hash2, err := KeyFromPassphraseArgon2id("correct horse battery staple", salt, opts)
+	if err != nil {
+		t.Fatalf("KeyFromPassphraseArgon2id failed: %v", err)
+	}
+
+	if !bytes.Equal(key1, key2) {
+		t.Error("same passphrase/salt/opts produced different keys")
+	}
+	if !bytes.Equal(hash1, hash2) {
+		t.Error("same passphrase/salt/opts produced different confirmation hashes")
+	}
+	if bytes.Equal(key1, hash1) {
+		t.Error("the wrapping key and confirmation hash must not be equal")
+	}
+}
+
+func TestKeyFromPassphraseArgon2idDifferentPassphrases(t *testing.T) {
+	salt := bytes.Repeat([]byte{0x24}, SaltLength)
+	opts := DefaultKdfOpts()
+
+	key1, _, err := KeyFromPassphraseArgon2id("passphrase one", salt, opts)
+	if err != nil {
+		t.Fatalf("KeyFromPassphraseArgon2id failed: %v", err)
+	}
+	key2, _, err := KeyFromPassphraseArgon2id("passphrase two", salt, opts)
+	if err != nil {
+		t.Fatalf("KeyFromPassphraseArgon2id failed: %v", err)
+	}
+
+	if bytes.Equal(key1, key2) {
+		t.Error("different passphrases produced the same key")
+	}
+}
@@ -0,0 +1,163 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+)
+
+// gf256Exp and gf256Log are lookup tables for GF(2^8) multiplication and division, using the AES/Rijndael
+// reduction polynomial (x^8 + x^4 + x^3 + x + 1, 0x11b), the same field used by Shamir's original scheme
+var gf256Exp [512]byte
+var gf256Log [256]byte
+
+func init() {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		gf256Exp[i] = x
+		gf256Log[x] = byte(i)
+		// Multiply x by the generator 0x03 in GF(2^8)
+		hi := x & 0x80
+		x <<= 1
+		if hi != 0 {
+			x ^= 0x1b
+		}
+		x ^= gf256Exp[i]
+	}
+	for i := 255; i < 512; i++ {
+		gf256Exp[i] = gf256Exp[i-255]
+	}
+}
+
+func gf256Mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gf256Exp[int(gf256Log[a])+int(gf256Log[b])]
+}
+
+func gf256Div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	if b == 0 {
+		panic("division by zero in GF(2^8)")
+	}
+	return gf256Exp[(int(gf256Log[a])-int(gf256Log[b])+255)%255]
+}
+
+// ShamirSplit splits secret into n shares, requiring threshold of them to reconstruct it
+// Each share is len(secret)+1 bytes: a one-byte x-coordinate followed by len(secret) y-bytes, one per byte of the secret
+func ShamirSplit(secret []byte, threshold int, n int) (shares [][]byte, err error) {
+	if threshold < 1 || n < threshold || n > 255 {
+		return nil, errors.New("invalid threshold/shares combination")
+	}
+
+	// Assign each share a distinct, non-zero x-coordinate
+	xCoords := make([]byte, n)
+	for i := 0; i < n; i++ {
+		xCoords[i] = byte(i + 1)
+	}
+
+	shares = make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = xCoords[i]
+	}
+
+	for byteIdx, secretByte := range secret {
+		// Random polynomial of degree threshold-1, with secretByte as the constant term
+		coeffs := make([]byte, threshold)
+		coeffs[0] = secretByte
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, err
+		}
+
+		for i, x := range xCoords {
+			shares[i][byteIdx+1] = evalPolynomial(coeffs, x)
+		}
+	}
+
+	return shares, nil
+}
+
+// ShamirCombine reconstructs the secret from a set of shares (at least `threshold` of them) produced by ShamirSplit
+func ShamirCombine(shares [][]byte) (secret []byte, err error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares provided")
+	}
+
+	secretLen := len(shares[0]) - 1
+	if secretLen < 1 {
+		return nil, errors.New("malformed share")
+	}
+
+	xCoords := make([]byte, len(shares))
+	seen := map[byte]bool{}
+	for i, s := range shares {
+		if len(s) != secretLen+1 {
+			return nil, errors.New("shares have inconsistent lengths")
+		}
+		if seen[s[0]] {
+			return nil, errors.New("duplicate share")
+		}
+		seen[s[0]] = true
+		xCoords[i] = s[0]
+	}
+
+	secret = make([]byte, secretLen)
+	for byteIdx := 0; byteIdx < secretLen; byteIdx++ {
+		ys := make([]byte, len(shares))
+		for i, s := range shares {
+			ys[i] = s[byteIdx+1]
+		}
+		secret[byteIdx] = lagrangeInterpolateZero(xCoords, ys)
+	}
+
+	return secret, nil
+}
+
+// evalPolynomial evaluates a polynomial (given by its coefficients, lowest degree first) at x, over GF(2^8)
+func evalPolynomial(coeffs []byte, x byte) byte {
+	result := byte(0)
+	// Horner's method, from the highest-degree coefficient down
+	for i := len(coeffs) - 1; i >= 0; i-- {
+		result = gf256Mul(result, x) ^ coeffs[i]
+	}
+	return result
+}
+
+// lagrangeInterpolateZero evaluates the Lagrange interpolation polynomial through (xs[i], ys[i]) at x=0
+func lagrangeInterpolateZero(xs []byte, ys []byte) byte {
+	result := byte(0)
+	for i := range xs {
+		num := byte(1)
+		den := byte(1)
+		for j := range xs {
+			if i == j {
+				continue
+			}
+			// Term for x=0: (0 - xs[j]) / (xs[i] - xs[j]); subtraction is XOR in GF(2^8)
+			num = gf256Mul(num, xs[j])
+			den = gf256Mul(den, xs[i]^xs[j])
+		}
+		result ^= gf256Mul(ys[i], gf256Div(num, den))
+	}
+	return result
+}
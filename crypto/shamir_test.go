@@ -0,0 +1,91 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestShamirRoundTrip(t *testing.T) {
+	secret := []byte("this is a 32-byte master key!!!!")
+
+	shares, err := ShamirSplit(secret, 3, 5)
+	if err != nil {
+		t.Fatalf("ShamirSplit failed: %v", err)
+	}
+	if len(shares) != 5 {
+		t.Fatalf("expected 5 shares, got %d", len(shares))
+	}
+
+	// Any 3 of the 5 shares should reconstruct the secret
+	combined, err := ShamirCombine(shares[1:4])
+	if err != nil {
+		t.Fatalf("ShamirCombine failed: %v", err)
+	}
+	if !bytes.Equal(combined, secret) {
+		t.Fatalf("reconstructed secret does not match: got %x, want %x", combined, secret)
+	}
+}
+
+func TestShamirThresholdNotMet(t *testing.T) {
+	secret := []byte("another secret!!")
+
+	shares, err := ShamirSplit(secret, 3, 5)
+	if err != nil {
+		t.Fatalf("ShamirSplit failed: %v", err)
+	}
+
+	// Only 2 of the required 3 shares: reconstruction succeeds arithmetically but must not yield the original secret
+	combined, err := ShamirCombine(shares[:2])
+	if err != nil {
+		t.Fatalf("ShamirCombine failed: %v", err)
+	}
+	if bytes.Equal(combined, secret) {
+		t.Fatal("reconstructed the secret from fewer than threshold shares")
+	}
+}
+
+func TestShamirRejectsInvalidParams(t *testing.T) {
+	secret := []byte("secret")
+
+	cases := []struct {
+		threshold int
+		n         int
+	}{
+		{0, 5},
+		{6, 5},
+		{3, 256},
+	}
+	for _, c := range cases {
+		if _, err := ShamirSplit(secret, c.threshold, c.n); err == nil {
+			t.Errorf("expected an error for threshold=%d n=%d, got none", c.threshold, c.n)
+		}
+	}
+}
+
+func TestShamirCombineRejectsDuplicateShares(t *testing.T) {
+	shares, err := ShamirSplit([]byte("secret"), 2, 3)
+	if err != nil {
+		t.Fatalf("ShamirSplit failed: %v", err)
+	}
+
+	if _, err := ShamirCombine([][]byte{shares[0], shares[0]}); err == nil {
+		t.Fatal("expected an error combining duplicate shares, got none")
+	}
+}
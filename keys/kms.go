@@ -0,0 +1,117 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package keys
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ItalyPaleAle/prvt/infofile"
+)
+
+// KeyManager is implemented by every cloud/remote key-wrapping backend
+// (AWS KMS today; GCP Cloud KMS, Azure Key Vault, and Vault Transit are recognized URI schemes reserved for
+// follow-up backends, but have no implementation yet)
+// The master key itself never leaves prvt; only the wrap/unwrap round-trip
+// is delegated to the remote service.
+type KeyManager interface {
+	// Wrap encrypts plaintext (the master key) and returns the ciphertext blob to store in the info file
+	Wrap(plaintext []byte) (ciphertext []byte, err error)
+	// Unwrap decrypts a ciphertext blob previously returned by Wrap
+	Unwrap(ciphertext []byte) (plaintext []byte, err error)
+}
+
+// NewKeyManager returns the KeyManager for a given key URI, based on its scheme
+// Only awskms:// is implemented; gcpkms://, azurekeyvault://, and vault:// are parsed but return an error,
+// since prvt --kms only supports AWS KMS for now
+func NewKeyManager(uri string) (KeyManager, error) {
+	switch {
+	case strings.HasPrefix(uri, "awskms://"):
+		return newAWSKeyManager(uri)
+	case strings.HasPrefix(uri, "gcpkms://"):
+		return newGCPKeyManager(uri)
+	case strings.HasPrefix(uri, "azurekeyvault://"):
+		return newAzureKeyManager(uri)
+	case strings.HasPrefix(uri, "vault://"):
+		return newVaultKeyManager(uri)
+	default:
+		return nil, fmt.Errorf("unsupported KMS URI scheme: %s", uri)
+	}
+}
+
+// KMSWrap wraps masterKey using the KMS identified by uri
+func KMSWrap(masterKey []byte, uri string) (wrappedKey []byte, err error) {
+	km, err := NewKeyManager(uri)
+	if err != nil {
+		return nil, err
+	}
+	return km.Wrap(masterKey)
+}
+
+// GetMasterKeyWithKMS attempts to unwrap the master key using a KMS-wrapped key stored in the info file
+func GetMasterKeyWithKMS(info *infofile.InfoFile) (masterKey []byte, keyId string, errMessage string, err error) {
+	if info == nil || len(info.Keys) == 0 {
+		return nil, "", "No KMS key found", errors.New("info file has no keys")
+	}
+
+	for _, k := range info.Keys {
+		if k.KMSKeyURI == "" || len(k.WrappedKey) == 0 {
+			continue
+		}
+
+		km, kmErr := NewKeyManager(k.KMSKeyURI)
+		if kmErr != nil {
+			err = kmErr
+			continue
+		}
+
+		masterKey, kmErr = km.Unwrap(k.WrappedKey)
+		if kmErr != nil {
+			err = kmErr
+			continue
+		}
+
+		return masterKey, k.KMSKeyURI, "", nil
+	}
+
+	if err == nil {
+		err = errors.New("no KMS-wrapped key could be found or unwrapped")
+	}
+	return nil, "", "Cannot unlock the repository with a KMS key", err
+}
+
+// newAWSKeyManager is implemented in kms_aws.go
+
+// newGCPKeyManager is reserved for a future GCP Cloud KMS backend
+// URI format: gcpkms://projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>
+func newGCPKeyManager(uri string) (KeyManager, error) {
+	return nil, errors.New("GCP Cloud KMS is not supported yet; only awskms:// is")
+}
+
+// newAzureKeyManager is reserved for a future Azure Key Vault backend
+// URI format: azurekeyvault://<vault-name>.vault.azure.net/keys/<key-name>
+func newAzureKeyManager(uri string) (KeyManager, error) {
+	return nil, errors.New("Azure Key Vault is not supported yet; only awskms:// is")
+}
+
+// newVaultKeyManager is reserved for a future HashiCorp Vault Transit backend
+// URI format: vault://transit/keys/prvt
+func newVaultKeyManager(uri string) (KeyManager, error) {
+	return nil, errors.New("HashiCorp Vault Transit is not supported yet; only awskms:// is")
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package keys
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+)
+
+// awsKeyManager is a KeyManager backed by AWS KMS's Encrypt/Decrypt APIs
+type awsKeyManager struct {
+	client *kms.Client
+	keyId  string
+}
+
+// newAWSKeyManager returns a KeyManager backed by AWS KMS, using a key identified by an alias or key ARN
+// URI format: awskms://alias/prvt-master or awskms://<key-id-or-arn>
+// Credentials and region are resolved the standard AWS way (environment, shared config, EC2/ECS metadata, etc.)
+func newAWSKeyManager(uri string) (KeyManager, error) {
+	keyId := strings.TrimPrefix(uri, "awskms://")
+	if keyId == "" {
+		return nil, errors.New("awskms URI must include a key alias or ARN, e.g. awskms://alias/prvt-master")
+	}
+
+	cfg, err := config.LoadDefaultConfig(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &awsKeyManager{client: kms.NewFromConfig(cfg), keyId: keyId}, nil
+}
+
+// Wrap encrypts plaintext with the configured AWS KMS key
+func (m *awsKeyManager) Wrap(plaintext []byte) (ciphertext []byte, err error) {
+	out, err := m.client.Encrypt(context.Background(), &kms.EncryptInput{
+		KeyId:     aws.String(m.keyId),
+		Plaintext: plaintext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.CiphertextBlob, nil
+}
+
+// Unwrap decrypts a ciphertext blob previously returned by Wrap
+func (m *awsKeyManager) Unwrap(ciphertext []byte) (plaintext []byte, err error) {
+	out, err := m.client.Decrypt(context.Background(), &kms.DecryptInput{
+		KeyId:          aws.String(m.keyId),
+		CiphertextBlob: ciphertext,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,66 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package keys
+
+import (
+	"crypto/subtle"
+	"errors"
+
+	"github.com/ItalyPaleAle/prvt/crypto"
+	"github.com/ItalyPaleAle/prvt/infofile"
+)
+
+// deriveWrappingKey derives a wrapping key and confirmation hash for a passphrase entry, dispatching on its KDF
+func deriveWrappingKey(passphrase string, salt []byte, kdf crypto.KdfAlgorithm, kdfOpts crypto.KdfOpts) (wrappingKey []byte, confirmationHash []byte, err error) {
+	if kdf == crypto.KdfArgon2id {
+		return crypto.KeyFromPassphraseArgon2id(passphrase, salt, kdfOpts)
+	}
+	// Missing or "legacy" KDF: fall back to the original KDF for backward compatibility
+	return crypto.KeyFromPassphrase(passphrase, salt)
+}
+
+// GetMasterKeyWithPassphrase attempts to unwrap the master key using a passphrase-wrapped key stored in the info
+// file, dispatching on each key's Kdf so both legacy and Argon2id-protected entries can be unlocked with the same passphrase
+func GetMasterKeyWithPassphrase(info *infofile.InfoFile, passphrase string) (masterKey []byte, keyId string, errMessage string, err error) {
+	if info == nil || len(info.Keys) == 0 {
+		return nil, "", "No passphrase found", errors.New("info file has no keys")
+	}
+
+	for _, k := range info.Keys {
+		if len(k.Salt) == 0 || len(k.ConfirmationHash) == 0 {
+			continue
+		}
+
+		wrappingKey, confirmationHash, deriveErr := deriveWrappingKey(passphrase, k.Salt, k.Kdf, k.KdfOpts)
+		if deriveErr != nil || subtle.ConstantTimeCompare(k.ConfirmationHash, confirmationHash) == 0 {
+			continue
+		}
+
+		masterKey, err = crypto.UnwrapKey(wrappingKey, k.WrappedKey)
+		if err != nil {
+			continue
+		}
+
+		return masterKey, "", "", nil
+	}
+
+	if err == nil {
+		err = errors.New("Invalid passphrase")
+	}
+	return nil, "", "Cannot unlock the repository", err
+}
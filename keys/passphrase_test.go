@@ -0,0 +1,119 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package keys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/ItalyPaleAle/prvt/crypto"
+	"github.com/ItalyPaleAle/prvt/infofile"
+)
+
+func addTestPassphrase(t *testing.T, info *infofile.InfoFile, passphrase string, kdf crypto.KdfAlgorithm, masterKey []byte) {
+	t.Helper()
+
+	salt, err := crypto.NewSalt()
+	if err != nil {
+		t.Fatalf("crypto.NewSalt failed: %v", err)
+	}
+
+	var wrappingKey, confirmationHash []byte
+	opts := crypto.KdfOpts{}
+	if kdf == crypto.KdfArgon2id {
+		opts = crypto.DefaultKdfOpts()
+		wrappingKey, confirmationHash, err = crypto.KeyFromPassphraseArgon2id(passphrase, salt, opts)
+	} else {
+		wrappingKey, confirmationHash, err = crypto.KeyFromPassphrase(passphrase, salt)
+	}
+	if err != nil {
+		t.Fatalf("failed to derive the wrapping key: %v", err)
+	}
+
+	wrappedKey, err := crypto.WrapKey(wrappingKey, masterKey)
+	if err != nil {
+		t.Fatalf("crypto.WrapKey failed: %v", err)
+	}
+
+	if err := info.AddPassphrase(salt, confirmationHash, wrappedKey, kdf, opts); err != nil {
+		t.Fatalf("info.AddPassphrase failed: %v", err)
+	}
+}
+
+func TestGetMasterKeyWithPassphraseArgon2idRoundTrip(t *testing.T) {
+	info, err := infofile.New()
+	if err != nil {
+		t.Fatalf("infofile.New failed: %v", err)
+	}
+
+	masterKey := make([]byte, crypto.KeyLength)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatalf("failed to generate a master key: %v", err)
+	}
+
+	addTestPassphrase(t, info, "correct horse battery staple", crypto.KdfArgon2id, masterKey)
+
+	got, _, _, err := GetMasterKeyWithPassphrase(info, "correct horse battery staple")
+	if err != nil {
+		t.Fatalf("GetMasterKeyWithPassphrase failed: %v", err)
+	}
+	if !bytes.Equal(got, masterKey) {
+		t.Fatalf("unwrapped master key does not match: got %x, want %x", got, masterKey)
+	}
+}
+
+func TestGetMasterKeyWithPassphraseLegacyKdfStillWorks(t *testing.T) {
+	info, err := infofile.New()
+	if err != nil {
+		t.Fatalf("infofile.New failed: %v", err)
+	}
+
+	masterKey := make([]byte, crypto.KeyLength)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatalf("failed to generate a master key: %v", err)
+	}
+
+	addTestPassphrase(t, info, "a legacy passphrase", crypto.KdfLegacy, masterKey)
+
+	got, _, _, err := GetMasterKeyWithPassphrase(info, "a legacy passphrase")
+	if err != nil {
+		t.Fatalf("GetMasterKeyWithPassphrase failed: %v", err)
+	}
+	if !bytes.Equal(got, masterKey) {
+		t.Fatalf("unwrapped master key does not match: got %x, want %x", got, masterKey)
+	}
+}
+
+func TestGetMasterKeyWithPassphraseWrongPassphrase(t *testing.T) {
+	info, err := infofile.New()
+	if err != nil {
+		t.Fatalf("infofile.New failed: %v", err)
+	}
+
+	masterKey := make([]byte, crypto.KeyLength)
+	if _, err := rand.Read(masterKey); err != nil {
+		t.Fatalf("failed to generate a master key: %v", err)
+	}
+
+	addTestPassphrase(t, info, "correct horse battery staple", crypto.KdfArgon2id, masterKey)
+
+	if _, _, _, err := GetMasterKeyWithPassphrase(info, "wrong passphrase"); err == nil {
+		t.Fatal("expected an error unlocking with the wrong passphrase, got none")
+	}
+}
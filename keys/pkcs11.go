@@ -0,0 +1,334 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package keys
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/ItalyPaleAle/prvt/crypto"
+	"github.com/ItalyPaleAle/prvt/infofile"
+
+	"github.com/manifoldco/promptui"
+	"github.com/miekg/pkcs11"
+)
+
+// pkcs11ModulePathEnv is the environment variable pointing to the PKCS#11 module (.so/.dll) to load
+const pkcs11ModulePathEnv = "PKCS11_MODULE_PATH"
+
+// PKCS11Wrap wraps masterKey using a key stored in a PKCS#11 module (HSM, YubiKey PIV, SoftHSM, etc.)
+// uri identifies the token and object, e.g. pkcs11:token=prvt;object=master-wrap-key
+func PKCS11Wrap(masterKey []byte, uri string) (wrappedKey []byte, err error) {
+	sess, err := openPKCS11Session(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.close()
+
+	// Prefer C_WrapKey when the module and object support it; fall back to RSA-OAEP encryption otherwise
+	wrappedKey, err = sess.wrapKey(masterKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return wrappedKey, nil
+}
+
+// PKCS11Unwrap unwraps a key previously wrapped with PKCS11Wrap
+func PKCS11Unwrap(wrappedKey []byte, uri string) (masterKey []byte, err error) {
+	sess, err := openPKCS11Session(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer sess.close()
+
+	masterKey, err = sess.unwrapKey(wrappedKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return masterKey, nil
+}
+
+// GetMasterKeyWithPKCS11 attempts to unwrap the master key using a PKCS#11-wrapped key stored in the info file
+func GetMasterKeyWithPKCS11(info *infofile.InfoFile) (masterKey []byte, keyId string, errMessage string, err error) {
+	if info == nil || len(info.Keys) == 0 {
+		return nil, "", "No PKCS#11 key found", errors.New("info file has no keys")
+	}
+
+	for _, k := range info.Keys {
+		if k.PKCS11URI == "" || len(k.WrappedKey) == 0 {
+			continue
+		}
+
+		masterKey, err = PKCS11Unwrap(k.WrappedKey, k.PKCS11URI)
+		if err != nil {
+			continue
+		}
+
+		return masterKey, k.PKCS11URI, "", nil
+	}
+
+	if err == nil {
+		err = errors.New("no PKCS#11-wrapped key could be found or unwrapped")
+	}
+	return nil, "", "Cannot unlock the repository with the PKCS#11 module", err
+}
+
+// pkcs11Session wraps a logged-in PKCS#11 session, ready to wrap/unwrap keys with a specific object
+// privKey is used to unwrap/decrypt; pubKey (when the token exposes one under the same label) is used to wrap/encrypt
+type pkcs11Session struct {
+	ctx     *pkcs11.Ctx
+	session pkcs11.SessionHandle
+	privKey pkcs11.ObjectHandle
+	pubKey  pkcs11.ObjectHandle
+}
+
+func (s *pkcs11Session) close() {
+	if s == nil || s.ctx == nil {
+		return
+	}
+	_ = s.ctx.Logout(s.session)
+	_ = s.ctx.CloseSession(s.session)
+	s.ctx.Destroy()
+}
+
+// pkcs11WrapMechanism is the mechanism used both to wrap/unwrap a temporary secret-key object and, as a fallback,
+// to encrypt/decrypt the master key directly against the RSA object
+func pkcs11WrapMechanism() *pkcs11.Mechanism {
+	return pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_OAEP, &pkcs11.OAEPParams{
+		HashAlg:    pkcs11.CKM_SHA256,
+		MGF:        pkcs11.CKG_MGF1_SHA256,
+		SourceType: pkcs11.CKZ_DATA_SPECIFIED,
+	})
+}
+
+// wrapKey tries C_WrapKey first, falling back to RSA-OAEP Encrypt when the module doesn't support key wrapping
+func (s *pkcs11Session) wrapKey(plaintext []byte) ([]byte, error) {
+	if s.pubKey == 0 {
+		return nil, errors.New("no public key object found alongside the private key; PKCS#11 wrapping needs both under the same label")
+	}
+
+	// C_WrapKey wraps a key object, not raw bytes, so stash the master key in a short-lived, extractable
+	// session-only secret-key object, wrap it, and immediately destroy it
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE, plaintext),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+	}
+	keyObj, err := s.ctx.CreateObject(s.session, tmpl)
+	if err == nil {
+		defer s.ctx.DestroyObject(s.session, keyObj)
+
+		wrapped, wrapErr := s.ctx.WrapKey(s.session, []*pkcs11.Mechanism{pkcs11WrapMechanism()}, s.pubKey, keyObj)
+		if wrapErr == nil {
+			return wrapped, nil
+		}
+	}
+
+	// Fall back to encrypting the master key directly with the RSA public key
+	if err := s.ctx.EncryptInit(s.session, []*pkcs11.Mechanism{pkcs11WrapMechanism()}, s.pubKey); err != nil {
+		return nil, err
+	}
+	return s.ctx.Encrypt(s.session, plaintext)
+}
+
+// unwrapKey tries C_UnwrapKey first, falling back to RSA-OAEP Decrypt
+func (s *pkcs11Session) unwrapKey(ciphertext []byte) ([]byte, error) {
+	tmpl := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_GENERIC_SECRET),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, crypto.KeyLength),
+	}
+	keyObj, err := s.ctx.UnwrapKey(s.session, []*pkcs11.Mechanism{pkcs11WrapMechanism()}, s.privKey, ciphertext, tmpl)
+	if err == nil {
+		defer s.ctx.DestroyObject(s.session, keyObj)
+
+		attrs, attrErr := s.ctx.GetAttributeValue(s.session, keyObj, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, nil),
+		})
+		if attrErr == nil && len(attrs) == 1 {
+			return attrs[0].Value, nil
+		}
+	}
+
+	// Fall back to decrypting the ciphertext directly with the RSA private key
+	if err := s.ctx.DecryptInit(s.session, []*pkcs11.Mechanism{pkcs11WrapMechanism()}, s.privKey); err != nil {
+		return nil, err
+	}
+	return s.ctx.Decrypt(s.session, ciphertext)
+}
+
+// openPKCS11Session opens the PKCS#11 module set in PKCS11_MODULE_PATH, logs in with a PIN prompt,
+// and locates the key pair identified by uri (a "pkcs11:token=...;object=..." URI)
+func openPKCS11Session(uri string) (*pkcs11Session, error) {
+	modulePath := os.Getenv(pkcs11ModulePathEnv)
+	if modulePath == "" {
+		return nil, errors.New(pkcs11ModulePathEnv + " is not set; it must point to a PKCS#11 module (e.g. opensc-pkcs11.so)")
+	}
+
+	tokenLabel, objectLabel, err := parsePKCS11URI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := pkcs11.New(modulePath)
+	if ctx == nil {
+		return nil, errors.New("could not load PKCS#11 module at " + modulePath)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return nil, err
+	}
+
+	slot, err := findPKCS11Slot(ctx, tokenLabel)
+	if err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+	if err != nil {
+		ctx.Destroy()
+		return nil, err
+	}
+
+	pin, err := promptPKCS11PIN()
+	if err != nil {
+		ctx.CloseSession(session)
+		ctx.Destroy()
+		return nil, err
+	}
+	if err := ctx.Login(session, pkcs11.CKU_USER, pin); err != nil {
+		ctx.CloseSession(session)
+		ctx.Destroy()
+		return nil, err
+	}
+
+	privKey, err := findPKCS11Object(ctx, session, pkcs11.CKO_PRIVATE_KEY, objectLabel)
+	if err != nil {
+		ctx.Logout(session)
+		ctx.CloseSession(session)
+		ctx.Destroy()
+		return nil, err
+	}
+
+	// The public key half is optional: it's only needed to wrap a new key, not to unwrap an existing one,
+	// and some tokens don't expose it as a separate object
+	pubKey, _ := findPKCS11Object(ctx, session, pkcs11.CKO_PUBLIC_KEY, objectLabel)
+
+	return &pkcs11Session{ctx: ctx, session: session, privKey: privKey, pubKey: pubKey}, nil
+}
+
+// promptPKCS11PIN prompts the user for the PKCS#11 token PIN
+func promptPKCS11PIN() (string, error) {
+	prompt := promptui.Prompt{
+		Validate: func(input string) error {
+			if len(input) < 1 {
+				return errors.New("PIN must not be empty")
+			}
+			return nil
+		},
+		Label: "PKCS#11 token PIN",
+		Mask:  '*',
+	}
+
+	return prompt.Run()
+}
+
+// parsePKCS11URI parses a "pkcs11:token=...;object=..." URI (RFC 7512, the subset prvt needs) into its
+// token and object labels. Attribute values may be percent-encoded, per the RFC
+func parsePKCS11URI(uri string) (tokenLabel string, objectLabel string, err error) {
+	const scheme = "pkcs11:"
+	if !strings.HasPrefix(uri, scheme) {
+		return "", "", errors.New(`PKCS#11 URI must start with "pkcs11:": ` + uri)
+	}
+
+	for _, part := range strings.Split(uri[len(scheme):], ";") {
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return "", "", errors.New("invalid PKCS#11 URI component: " + part)
+		}
+
+		value, decErr := url.PathUnescape(kv[1])
+		if decErr != nil {
+			return "", "", decErr
+		}
+		switch kv[0] {
+		case "token":
+			tokenLabel = value
+		case "object":
+			objectLabel = value
+		}
+	}
+
+	if tokenLabel == "" || objectLabel == "" {
+		return "", "", errors.New("PKCS#11 URI must specify both token and object: " + uri)
+	}
+
+	return tokenLabel, objectLabel, nil
+}
+
+// findPKCS11Slot finds the slot for a token by its label
+func findPKCS11Slot(ctx *pkcs11.Ctx, tokenLabel string) (uint, error) {
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return 0, err
+	}
+	for _, slot := range slots {
+		info, err := ctx.GetTokenInfo(slot)
+		if err != nil {
+			continue
+		}
+		if info.Label == tokenLabel {
+			return slot, nil
+		}
+	}
+	return 0, errors.New("no token found with label " + tokenLabel)
+}
+
+// findPKCS11Object finds an RSA or ECC key object of the given class (CKO_PRIVATE_KEY or CKO_PUBLIC_KEY) by its label
+func findPKCS11Object(ctx *pkcs11.Ctx, session pkcs11.SessionHandle, class uint, objectLabel string) (pkcs11.ObjectHandle, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, objectLabel),
+	}
+	if err := ctx.FindObjectsInit(session, template); err != nil {
+		return 0, err
+	}
+	defer ctx.FindObjectsFinal(session)
+
+	objs, _, err := ctx.FindObjects(session, 1)
+	if err != nil {
+		return 0, err
+	}
+	if len(objs) == 0 {
+		return 0, errors.New("no key object found with label " + objectLabel)
+	}
+	return objs[0], nil
+}
@@ -0,0 +1,182 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package keys
+
+import (
+	"crypto/sha256"
+	"errors"
+	"net"
+	"os"
+
+	"github.com/ItalyPaleAle/prvt/crypto"
+	"github.com/ItalyPaleAle/prvt/infofile"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// sshAgentChallengeInfo is the HKDF "info" parameter for deriving a wrapping key from an agent signature
+const sshAgentChallengeInfo = "prvt ssh-agent wrapping key v1"
+
+// The ssh-agent protocol only exposes a Sign operation, not a generic decrypt, so unlike GPG/KMS/PKCS#11 the
+// wrapping key here can't be a literal RSA-OAEP encryption the agent later decrypts. Instead, for every key type,
+// including RSA, we derive a stable 32-byte wrapping key by asking the agent to sign the info-file-specific salt
+// and running HKDF-SHA256 over the resulting signature. This only works if the agent's signature is deterministic
+// for a given input, which holds for Ed25519 and for RSA signed with PKCS#1v1.5 (ssh-agent's default for RSA keys),
+// but NOT for ECDSA, whose signatures are randomized unless the agent implements RFC 6979.
+
+// dialSSHAgent connects to the running ssh-agent via SSH_AUTH_SOCK
+func dialSSHAgent() (agent.Agent, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, errors.New("SSH_AUTH_SOCK is not set; is ssh-agent running?")
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, err
+	}
+
+	return agent.NewClient(conn), nil
+}
+
+// findAgentKey returns the identity in the agent matching fingerprint, or the first identity if fingerprint is empty
+func findAgentKey(a agent.Agent, fingerprint string) (*agent.Key, error) {
+	keyList, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	if len(keyList) == 0 {
+		return nil, errors.New("ssh-agent has no keys loaded")
+	}
+
+	if fingerprint == "" {
+		return keyList[0], nil
+	}
+
+	for _, k := range keyList {
+		if ssh.FingerprintSHA256(k) == fingerprint {
+			return k, nil
+		}
+	}
+
+	return nil, errors.New("no key with fingerprint " + fingerprint + " found in ssh-agent")
+}
+
+// sshAgentWrappingKey derives a 32-byte wrapping key from an ssh-agent identity by signing salt
+func sshAgentWrappingKey(a agent.Agent, k *agent.Key, salt []byte) ([]byte, error) {
+	pub, err := ssh.ParsePublicKey(k.Blob)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Type() == ssh.KeyAlgoECDSA256 || pub.Type() == ssh.KeyAlgoECDSA384 || pub.Type() == ssh.KeyAlgoECDSA521 {
+		return nil, errors.New("ECDSA ssh-agent keys are not supported, as their signatures aren't deterministic; use an Ed25519 or RSA key instead")
+	}
+
+	sig, err := a.Sign(pub, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	h := hkdf.New(sha256.New, sig.Blob, salt, []byte(sshAgentChallengeInfo))
+	wrappingKey := make([]byte, 32)
+	if _, err := h.Read(wrappingKey); err != nil {
+		return nil, err
+	}
+
+	return wrappingKey, nil
+}
+
+// SSHAgentWrap wraps masterKey using a key loaded in ssh-agent, identified by its SHA256 fingerprint
+// (or the first available key, if fingerprint is empty). Returns the fingerprint, the public key blob, and the
+// per-key salt used to derive the wrapping key, all of which are stored in the info file so the same identity
+// can be requested again on unlock
+func SSHAgentWrap(masterKey []byte, fingerprint string) (usedFingerprint string, pubkey []byte, salt []byte, wrappedKey []byte, err error) {
+	a, err := dialSSHAgent()
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	k, err := findAgentKey(a, fingerprint)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	salt, err = crypto.NewSalt()
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	wrappingKey, err := sshAgentWrappingKey(a, k, salt)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	wrappedKey, err = crypto.WrapKey(wrappingKey, masterKey)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	return ssh.FingerprintSHA256(k), k.Blob, salt, wrappedKey, nil
+}
+
+// SSHAgentUnwrap unwraps a key previously wrapped with SSHAgentWrap, using the same agent identity
+func SSHAgentUnwrap(wrappedKey []byte, salt []byte, fingerprint string) (masterKey []byte, err error) {
+	a, err := dialSSHAgent()
+	if err != nil {
+		return nil, err
+	}
+
+	k, err := findAgentKey(a, fingerprint)
+	if err != nil {
+		return nil, err
+	}
+
+	wrappingKey, err := sshAgentWrappingKey(a, k, salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return crypto.UnwrapKey(wrappingKey, wrappedKey)
+}
+
+// GetMasterKeyWithSSHAgent attempts to unwrap the master key using an SSH-agent-wrapped key stored in the info file
+func GetMasterKeyWithSSHAgent(info *infofile.InfoFile) (masterKey []byte, keyId string, errMessage string, err error) {
+	if info == nil || len(info.Keys) == 0 {
+		return nil, "", "No SSH key found", errors.New("info file has no keys")
+	}
+
+	for _, k := range info.Keys {
+		if k.SSHFingerprint == "" || len(k.WrappedKey) == 0 {
+			continue
+		}
+
+		masterKey, err = SSHAgentUnwrap(k.WrappedKey, k.Salt, k.SSHFingerprint)
+		if err != nil {
+			continue
+		}
+
+		return masterKey, k.SSHFingerprint, "", nil
+	}
+
+	if err == nil {
+		err = errors.New("no ssh-agent-wrapped key could be found or unwrapped; is the right key loaded in the agent?")
+	}
+	return nil, "", "Cannot unlock the repository with ssh-agent", err
+}
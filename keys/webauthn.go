@@ -0,0 +1,157 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package keys
+
+import (
+	"crypto/rand"
+	"errors"
+
+	"github.com/ItalyPaleAle/prvt/crypto"
+	"github.com/ItalyPaleAle/prvt/infofile"
+
+	"github.com/keys-pub/go-libfido2"
+)
+
+// webAuthnHmacSecretExtension is the CTAP2 HMAC-secret salt length, per the FIDO2 spec
+const webAuthnHmacSecretExtension = 32
+
+// EnrollWebAuthn enrolls a new FIDO2 security key over CTAP2, using the hmac-secret extension to derive a stable
+// secret that wraps the master key. The rpId is derived from the info file's UUID, so credentials aren't shared
+// across repos.
+//
+// This CLI-side enrollment is for unlocking with the prvt CLI itself. It is NOT usable from the WASM UI: browsers
+// only accept an rpId that is the page's own origin or a registrable suffix of it, so a credential enrolled here
+// with a synthetic "<uuid>.prvt.local" rpId will make navigator.credentials.get fail with a SecurityError no matter
+// what domain the WASM UI is served from. Unlocking the WASM UI with a security key requires enrolling the
+// credential directly in the browser (via navigator.credentials.create under that page's real origin) instead of
+// through this function; that enrollment path isn't implemented yet.
+func EnrollWebAuthn(info *infofile.InfoFile, masterKey []byte, devicePath string) (errMessage string, err error) {
+	// The CTAP2 hmac-secret extension requires a salt of exactly 32 bytes, which doesn't match crypto.SaltLength,
+	// so this can't reuse crypto.NewSalt() like the other backends do
+	salt := make([]byte, webAuthnHmacSecretExtension)
+	if _, err := rand.Read(salt); err != nil {
+		return "Error generating a new salt", err
+	}
+
+	rpId := webAuthnRpId(info)
+
+	device, err := libfido2.NewDevice(devicePath)
+	if err != nil {
+		return "Error opening the FIDO2 device", err
+	}
+
+	cred, err := device.MakeCredential(
+		make([]byte, 32), // clientDataHash: not verified locally, since there's no relying-party server involved
+		libfido2.RelyingParty{ID: rpId, Name: "prvt"},
+		libfido2.User{ID: []byte(rpId), Name: rpId},
+		libfido2.ES256,
+		"",
+		&libfido2.MakeCredentialOpts{Extensions: []libfido2.Extension{libfido2.HMACSecretExtension}},
+	)
+	if err != nil {
+		return "Error creating the FIDO2 credential", err
+	}
+
+	secret, err := device.Assertion(
+		rpId,
+		make([]byte, 32),
+		[][]byte{cred.ID},
+		"",
+		&libfido2.AssertionOpts{Extensions: []libfido2.Extension{libfido2.HMACSecretExtension}, HMACSalt: salt},
+	)
+	if err != nil {
+		return "Error requesting the hmac-secret extension", err
+	}
+	if len(secret.HMACSecret) < 32 {
+		return "Error requesting the hmac-secret extension", errors.New("the security key did not return a usable hmac-secret")
+	}
+
+	wrappedKey, err := crypto.WrapKey(secret.HMACSecret[:32], masterKey)
+	if err != nil {
+		return "Error wrapping the master key", err
+	}
+
+	err = info.AddWebAuthnWrappedKey(cred.ID, salt, rpId, wrappedKey)
+	if err != nil {
+		return "Error adding the key", err
+	}
+
+	return "", nil
+}
+
+// GetMasterKeyWithWebAuthn attempts to unwrap the master key using a FIDO2 security key over CTAP2, for the CLI.
+// This only matches credentials enrolled by EnrollWebAuthn (CLI-side, synthetic rpId); it cannot assert a
+// credential the WASM UI created in the browser, since that credential's rpId is the page's own origin, not the
+// "<uuid>.prvt.local" value CTAP2 is asked for here (the WASM UI instead calls navigator.credentials.get in the
+// browser and passes the resulting secret to UnwrapWebAuthnSecret)
+func GetMasterKeyWithWebAuthn(info *infofile.InfoFile, devicePath string) (masterKey []byte, keyId string, errMessage string, err error) {
+	if info == nil || len(info.Keys) == 0 {
+		return nil, "", "No WebAuthn key found", errors.New("info file has no keys")
+	}
+
+	device, err := libfido2.NewDevice(devicePath)
+	if err != nil {
+		return nil, "", "Error opening the FIDO2 device", err
+	}
+
+	for _, k := range info.Keys {
+		if k.CredentialId == nil || len(k.WrappedKey) == 0 {
+			continue
+		}
+
+		secret, assertErr := device.Assertion(
+			k.RpId,
+			make([]byte, 32),
+			[][]byte{k.CredentialId},
+			"",
+			&libfido2.AssertionOpts{Extensions: []libfido2.Extension{libfido2.HMACSecretExtension}, HMACSalt: k.Salt},
+		)
+		if assertErr != nil || len(secret.HMACSecret) < 32 {
+			err = assertErr
+			continue
+		}
+
+		masterKey, err = crypto.UnwrapKey(secret.HMACSecret[:32], k.WrappedKey)
+		if err != nil {
+			continue
+		}
+
+		return masterKey, k.RpId, "", nil
+	}
+
+	if err == nil {
+		err = errors.New("no WebAuthn-wrapped key could be found or unwrapped")
+	}
+	return nil, "", "Cannot unlock the repository with the FIDO2 security key", err
+}
+
+// UnwrapWebAuthnSecret unwraps the master key given a secret already obtained by the caller (e.g. the WASM UI,
+// which requests the hmac-secret extension via navigator.credentials.get instead of speaking CTAP2 directly)
+func UnwrapWebAuthnSecret(wrappedKey []byte, secret []byte) (masterKey []byte, err error) {
+	if len(secret) < 32 {
+		return nil, errors.New("the provided secret is too short")
+	}
+	return crypto.UnwrapKey(secret[:32], wrappedKey)
+}
+
+// webAuthnRpId derives a stable relying-party ID for the repository from its UUID, for CLI-side CTAP2 enrollment
+// and assertion. It is deliberately not a real, resolvable domain: no relying-party server is involved when
+// speaking CTAP2 directly to the device, only when a browser mediates via navigator.credentials (see EnrollWebAuthn)
+func webAuthnRpId(info *infofile.InfoFile) string {
+	return info.UUID + ".prvt.local"
+}
@@ -35,8 +35,10 @@ const MaxSafeInteger = 9007199254740991
 func main() {
 	// Export a "Prvt" global object that contains our functions
 	js.Global().Set("Prvt", map[string]interface{}{
-		"decryptRequest": DecryptRequest(),
-		"getIndex":       GetIndex(),
+		"decryptRequest":        DecryptRequest(),
+		"getIndex":              GetIndex(),
+		"setWebAuthnWrappedKey": SetWebAuthnWrappedKey(),
+		"unlockWithSecret":      UnlockWithSecret(),
 	})
 
 	// Prevent the function from returning, which is required in a wasm module
@@ -0,0 +1,84 @@
+/*
+Copyright © 2020 Alessandro Segala (@ItalyPaleAle)
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+
+package main
+
+import (
+	"syscall/js"
+
+	"github.com/ItalyPaleAle/prvt/keys"
+)
+
+// webAuthnWrappedKey holds the wrapped master key for the WebAuthn-enrolled credential currently loaded,
+// set by SetWebAuthnWrappedKey once the info file has been fetched, and consumed by UnlockWithSecret
+var webAuthnWrappedKey []byte
+
+// SetWebAuthnWrappedKey exports "Prvt.setWebAuthnWrappedKey(wrappedKey)", storing the wrapped key for the
+// credential the UI is about to request via navigator.credentials.get, ahead of calling unlockWithSecret
+func SetWebAuthnWrappedKey() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 {
+			return jsError("Argument wrappedKey is required")
+		}
+		webAuthnWrappedKey = jsUint8ArrayToBytes(args[0])
+		return nil
+	})
+}
+
+// UnlockWithSecret exports "Prvt.unlockWithSecret(secret)": secret is the 32-byte hmac-secret extension output
+// obtained by the UI from navigator.credentials.get({publicKey: {..., extensions: {hmacGetSecret: {salt1}}}}),
+// and the return value is the unwrapped master key, as a Uint8Array
+// This only works for a credential that was created with an rpId matching the page's own origin (i.e. registered
+// via navigator.credentials.create in the browser); it cannot unlock a key enrolled with the CLI's
+// keys.EnrollWebAuthn, whose synthetic rpId a browser will never accept
+func UnlockWithSecret() js.Func {
+	return js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		if len(args) < 1 {
+			return jsError("Argument secret is required")
+		}
+		if webAuthnWrappedKey == nil {
+			return jsError("setWebAuthnWrappedKey must be called before unlockWithSecret")
+		}
+
+		secret := jsUint8ArrayToBytes(args[0])
+		masterKey, err := keys.UnwrapWebAuthnSecret(webAuthnWrappedKey, secret)
+		if err != nil {
+			return jsError(err.Error())
+		}
+
+		return bytesToJsUint8Array(masterKey)
+	})
+}
+
+// jsUint8ArrayToBytes copies a JS Uint8Array into a Go byte slice
+func jsUint8ArrayToBytes(v js.Value) []byte {
+	b := make([]byte, v.Get("length").Int())
+	js.CopyBytesToGo(b, v)
+	return b
+}
+
+// bytesToJsUint8Array copies a Go byte slice into a new JS Uint8Array
+func bytesToJsUint8Array(b []byte) js.Value {
+	arr := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(arr, b)
+	return arr
+}
+
+// jsError returns a JS Error object with the given message
+func jsError(message string) js.Value {
+	return js.Global().Get("Error").New(message)
+}